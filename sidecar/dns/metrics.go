@@ -0,0 +1,110 @@
+// Copyright 2016 IBM Corporation
+//
+//   Licensed under the Apache License, Version 2.0 (the "License");
+//   you may not use this file except in compliance with the License.
+//   You may obtain a copy of the License at
+//
+//       http://www.apache.org/licenses/LICENSE-2.0
+//
+//   Unless required by applicable law or agreed to in writing, software
+//   distributed under the License is distributed on an "AS IS" BASIS,
+//   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+//   See the License for the specific language governing permissions and
+//   limitations under the License.
+
+package dns
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricsNamespace groups the DNS server's Prometheus collectors.
+const metricsNamespace = "dns"
+
+// Metrics is the instrumentation hook for the DNS server. Implementations must be safe for
+// concurrent use, since queries are handled concurrently by the underlying dns.Server.
+type Metrics interface {
+	// IncQueryCount increments the count of queries handled, by question type and the
+	// response code the server returned.
+	IncQueryCount(qtype, rcode string)
+
+	// ObserveLatency records how long a query of the given type took to answer.
+	ObserveLatency(qtype string, d time.Duration)
+
+	// IncDiscoveryError increments the count of errors returned by the discovery client
+	// while answering a query.
+	IncDiscoveryError()
+
+	// ObserveAnswerSize records the number of records returned in a query's answer.
+	ObserveAnswerSize(qtype string, count int)
+}
+
+// noopMetrics is the default Metrics used when Config.Metrics is unset.
+type noopMetrics struct{}
+
+func (noopMetrics) IncQueryCount(qtype, rcode string)            {}
+func (noopMetrics) ObserveLatency(qtype string, d time.Duration) {}
+func (noopMetrics) IncDiscoveryError()                           {}
+func (noopMetrics) ObserveAnswerSize(qtype string, count int)    {}
+
+// PrometheusMetrics is the default Prometheus-backed Metrics implementation.
+type PrometheusMetrics struct {
+	queryCount     *prometheus.CounterVec
+	queryLatency   *prometheus.HistogramVec
+	discoveryError prometheus.Counter
+	answerSize     *prometheus.HistogramVec
+}
+
+// NewPrometheusMetrics creates a PrometheusMetrics and registers its collectors with the
+// given registerer. Pass prometheus.DefaultRegisterer to use the global registry.
+func NewPrometheusMetrics(registerer prometheus.Registerer) *PrometheusMetrics {
+	m := &PrometheusMetrics{
+		queryCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "query_count",
+			Help:      "Total number of DNS queries handled, by question type and response code.",
+		}, []string{"qtype", "rcode"}),
+		queryLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "query_latency_seconds",
+			Help:      "Time taken to answer a DNS query, by question type.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"qtype"}),
+		discoveryError: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "discovery_errors_total",
+			Help:      "Total number of errors returned by the discovery client while answering DNS queries.",
+		}),
+		answerSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "answer_size",
+			Help:      "Number of records returned in a DNS answer, by question type.",
+			Buckets:   prometheus.LinearBuckets(0, 1, 10),
+		}, []string{"qtype"}),
+	}
+
+	registerer.MustRegister(m.queryCount, m.queryLatency, m.discoveryError, m.answerSize)
+	return m
+}
+
+// IncQueryCount implements Metrics.
+func (m *PrometheusMetrics) IncQueryCount(qtype, rcode string) {
+	m.queryCount.WithLabelValues(qtype, rcode).Inc()
+}
+
+// ObserveLatency implements Metrics.
+func (m *PrometheusMetrics) ObserveLatency(qtype string, d time.Duration) {
+	m.queryLatency.WithLabelValues(qtype).Observe(d.Seconds())
+}
+
+// IncDiscoveryError implements Metrics.
+func (m *PrometheusMetrics) IncDiscoveryError() {
+	m.discoveryError.Inc()
+}
+
+// ObserveAnswerSize implements Metrics.
+func (m *PrometheusMetrics) ObserveAnswerSize(qtype string, count int) {
+	m.answerSize.WithLabelValues(qtype).Observe(float64(count))
+}
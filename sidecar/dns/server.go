@@ -15,11 +15,15 @@
 package dns
 
 import (
+	"bytes"
 	"fmt"
 	"net"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/amalgam8/amalgam8/registry/client"
@@ -27,10 +31,40 @@ import (
 	"math/rand"
 )
 
+const (
+	// defaultUDPSize is the UDP payload size assumed for clients that don't advertise EDNS0
+	defaultUDPSize = 512
+
+	// maxUDPSize is the largest UDP payload size we'll honor from a client's EDNS0 OPT record
+	maxUDPSize = 4096
+
+	// defaultUDPAnswerLimit caps the number of records returned over UDP absent an explicit config
+	defaultUDPAnswerLimit = 8
+
+	// defaultRecursorTimeout bounds how long we wait on a single recursor before trying the next one
+	defaultRecursorTimeout = 2 * time.Second
+
+	// maxCNAMEChases caps the number of follow-on lookups we perform when a recursor's reply
+	// ends in a CNAME, to avoid chasing a referral loop
+	maxCNAMEChases = 3
+
+	// defaultSRVWeight is used for instances that don't advertise a weight tag, so that a
+	// heterogeneous fleet (only some instances tagged) degrades gracefully rather than
+	// starving untagged instances of traffic.
+	defaultSRVWeight = 1
+
+	srvPriorityTagPrefix = "priority="
+	srvWeightTagPrefix   = "weight="
+)
+
 // Server represent a DNS server. has config field for port,domain,and client discovery, and the DNS server itself
 type Server struct {
-	config    Config
-	dnsServer *dns.Server
+	config       Config
+	dnsServerUDP *dns.Server
+	dnsServerTCP *dns.Server
+
+	forwardedQueries uint64
+	recursorTimeouts uint64
 }
 
 // Config represents the DNS server configurations.
@@ -38,6 +72,50 @@ type Config struct {
 	DiscoveryClient client.Discovery
 	Port            uint16
 	Domain          string
+
+	// EnableTruncate, when true, trims Answer/Extra down to UDPAnswerLimit records each on every UDP
+	// response. The Truncated flag is set on UDP responses that still exceed the negotiated payload
+	// size, whether or not EnableTruncate is set.
+	EnableTruncate bool
+
+	// UDPAnswerLimit bounds the number of records returned over UDP when EnableTruncate is set.
+	// Defaults to defaultUDPAnswerLimit.
+	UDPAnswerLimit int
+
+	// MaxUDPSize caps the UDP payload size negotiated via a client's EDNS0 OPT record.
+	// Defaults to maxUDPSize.
+	MaxUDPSize uint16
+
+	// ServiceTTL overrides the TTL used for records of a given service, keyed by service name.
+	// Services not present here fall back to DefaultTTL.
+	ServiceTTL map[string]time.Duration
+
+	// DefaultTTL is the TTL applied to records of services not listed in ServiceTTL.
+	DefaultTTL time.Duration
+
+	// SOA configures the authority record synthesized for the zone.
+	SOA SOAConfig
+
+	// Recursors are upstream DNS servers ("host:port") queried, in order, for names outside
+	// Config.Domain or that resolve to NODATA within it. Recursion is disabled when empty.
+	Recursors []string
+
+	// RecursorTimeout bounds how long to wait on a single recursor before trying the next one.
+	// Defaults to defaultRecursorTimeout.
+	RecursorTimeout time.Duration
+
+	// Metrics receives instrumentation about query handling. Defaults to a no-op
+	// implementation; use NewPrometheusMetrics for the default Prometheus-backed one.
+	Metrics Metrics
+}
+
+// SOAConfig configures the SOA record the server synthesizes for its zone, so that other
+// resolvers can cache and delegate to it as a proper authoritative zone.
+type SOAConfig struct {
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	MinTTL  uint32
 }
 
 // NewServer creates a new instance of a DNS server with the given configurations
@@ -53,49 +131,98 @@ func NewServer(config Config) (*Server, error) {
 	// Setup DNS muxing
 	mux := dns.NewServeMux()
 	mux.HandleFunc(config.Domain, s.handleRequest)
+	// Reverse zones for PTR lookups against registered instances.
+	mux.HandleFunc("in-addr.arpa.", s.handleRequest)
+	mux.HandleFunc("ip6.arpa.", s.handleRequest)
+	if len(config.Recursors) > 0 {
+		// Catch queries for names outside our zone so they can be forwarded to a recursor.
+		mux.HandleFunc(".", s.handleRequest)
+	}
+
+	addr := fmt.Sprintf(":%d", config.Port)
 
-	// Setup a DNS server
-	s.dnsServer = &dns.Server{
-		Addr:    fmt.Sprintf(":%d", config.Port),
+	// Setup a UDP DNS server
+	s.dnsServerUDP = &dns.Server{
+		Addr:    addr,
 		Net:     "udp",
 		Handler: mux,
 	}
 
+	// Setup a companion TCP DNS server, so that large responses that don't fit in a UDP
+	// datagram can be retried by well-behaved clients.
+	s.dnsServerTCP = &dns.Server{
+		Addr:    addr,
+		Net:     "tcp",
+		Handler: mux,
+	}
+
 	return s, nil
 }
 
-// ListenAndServe starts the DNS server
+// ListenAndServe starts the DNS server, listening for both UDP and TCP connections
 func (s *Server) ListenAndServe() error {
 	logrus.Info("Starting DNS server")
-	err := s.dnsServer.ListenAndServe()
 
-	if err != nil {
-		logrus.WithError(err).Errorf("Error starting DNS server")
+	tcpErrCh := make(chan error, 1)
+	udpErrCh := make(chan error, 1)
+	go func() {
+		tcpErrCh <- s.dnsServerTCP.ListenAndServe()
+	}()
+	go func() {
+		udpErrCh <- s.dnsServerUDP.ListenAndServe()
+	}()
+
+	select {
+	case err := <-tcpErrCh:
+		if err != nil {
+			logrus.WithError(err).Errorf("Error starting TCP DNS server")
+			if shutdownErr := s.dnsServerUDP.Shutdown(); shutdownErr != nil {
+				logrus.WithError(shutdownErr).Errorf("Error shutting down UDP DNS server after TCP failure")
+			}
+		}
+		return err
+	case err := <-udpErrCh:
+		if err != nil {
+			logrus.WithError(err).Errorf("Error starting UDP DNS server")
+			if shutdownErr := s.dnsServerTCP.Shutdown(); shutdownErr != nil {
+				logrus.WithError(shutdownErr).Errorf("Error shutting down TCP DNS server after UDP failure")
+			}
+		}
+		return err
 	}
-
-	return nil
 }
 
-// Shutdown stops the DNS server
+// Shutdown stops the DNS server, shutting down both the UDP and TCP listeners
 func (s *Server) Shutdown() error {
 	logrus.Info("Shutting down DNS server")
-	err := s.dnsServer.Shutdown()
 
-	if err != nil {
-		logrus.WithError(err).Errorf("Error shutting down DNS server")
-	} else {
-		logrus.Info("DNS server has shutdown")
+	errUDP := s.dnsServerUDP.Shutdown()
+	if errUDP != nil {
+		logrus.WithError(errUDP).Errorf("Error shutting down UDP DNS server")
 	}
 
-	return err
+	errTCP := s.dnsServerTCP.Shutdown()
+	if errTCP != nil {
+		logrus.WithError(errTCP).Errorf("Error shutting down TCP DNS server")
+	}
+
+	if errUDP == nil && errTCP == nil {
+		logrus.Info("DNS server has shutdown")
+	}
+	if errUDP != nil {
+		return errUDP
+	}
+	return errTCP
 }
 
 func (s *Server) handleRequest(w dns.ResponseWriter, request *dns.Msg) {
+	start := time.Now()
+
 	response := new(dns.Msg)
 	response.SetReply(request)
 	response.Extra = request.Extra
 	response.Authoritative = true
-	response.RecursionAvailable = false
+	response.RecursionAvailable = len(s.config.Recursors) > 0
 
 	for i, question := range request.Question {
 		err := s.handleQuestion(question, request, response)
@@ -105,12 +232,83 @@ func (s *Server) handleRequest(w dns.ResponseWriter, request *dns.Msg) {
 			break
 		}
 	}
+
+	_, isTCP := w.RemoteAddr().(*net.TCPAddr)
+	s.fitResponse(request, response, isTCP)
+
+	elapsed := time.Since(start)
+	qtype := "NONE"
+	if len(request.Question) > 0 {
+		qtype = dns.Type(request.Question[0].Qtype).String()
+	}
+	rcode := dns.RcodeToString[response.Rcode]
+
+	s.config.Metrics.IncQueryCount(qtype, rcode)
+	s.config.Metrics.ObserveLatency(qtype, elapsed)
+
+	logrus.WithFields(logrus.Fields{
+		"client":   w.RemoteAddr().String(),
+		"question": request.Question,
+		"rcode":    rcode,
+		"answers":  len(response.Answer),
+		"elapsed":  elapsed,
+	}).Debug("handled DNS query")
+
 	err := w.WriteMsg(response)
 	if err != nil {
 		logrus.WithError(err).Errorf("Error writing DNS response")
 	}
 }
 
+// fitResponse negotiates the client's EDNS0 UDP payload size (if advertised), echoes an OPT
+// record back on the response, and truncates or flags the response as Truncated so that it
+// respects UDP datagram limits. TCP responses are left untouched, since TCP has no such limit.
+func (s *Server) fitResponse(request, response *dns.Msg, isTCP bool) {
+	edns := request.IsEdns0()
+
+	udpSize := uint16(defaultUDPSize)
+	if edns != nil {
+		udpSize = edns.UDPSize()
+		if udpSize < defaultUDPSize {
+			udpSize = defaultUDPSize
+		}
+	}
+
+	maxSize := s.config.MaxUDPSize
+	if maxSize == 0 {
+		maxSize = maxUDPSize
+	}
+	if udpSize > maxSize {
+		udpSize = maxSize
+	}
+
+	if edns != nil {
+		response.SetEdns0(udpSize, edns.Do())
+	}
+
+	if isTCP {
+		return
+	}
+
+	answerLimit := s.config.UDPAnswerLimit
+	if answerLimit <= 0 {
+		answerLimit = defaultUDPAnswerLimit
+	}
+
+	if s.config.EnableTruncate {
+		if len(response.Answer) > answerLimit {
+			response.Answer = response.Answer[:answerLimit]
+		}
+		if len(response.Extra) > answerLimit {
+			response.Extra = response.Extra[:answerLimit]
+		}
+	}
+
+	if response.Len() > int(udpSize) {
+		response.Truncated = true
+	}
+}
+
 func (s *Server) handleQuestion(question dns.Question, request, response *dns.Msg) error {
 
 	switch question.Qclass {
@@ -120,25 +318,149 @@ func (s *Server) handleQuestion(question dns.Question, request, response *dns.Ms
 		return fmt.Errorf("unsupported DNS question class: %v", dns.Class(question.Qclass).String())
 	}
 
+	// PTR queries live in the in-addr.arpa/ip6.arpa reverse zones, not under Config.Domain.
+	// Gate on the actual suffix rather than just Qtype: a PTR query reaching us through the
+	// catch-all "." route for some other name must still fall through to the forward check below.
+	if question.Qtype == dns.TypePTR && isReverseZoneName(question.Name) {
+		return s.handlePTRQuestion(question, request, response)
+	}
+
+	// Names outside our zone can't be answered from the registry; forward them to a recursor.
+	if !dns.IsSubDomain(s.config.Domain, question.Name) {
+		return s.forwardQuestion(question, request, response)
+	}
+
 	switch question.Qtype {
 	case dns.TypeA:
 	case dns.TypeAAAA:
 	case dns.TypeSRV:
+	case dns.TypeSOA:
+	case dns.TypeNS:
 	default:
 		response.SetRcode(request, dns.RcodeServerFailure)
 		return fmt.Errorf("unsupported DNS question type: %v", dns.Type(question.Qtype).String())
 	}
 
+	// SOA and NS only make sense against the zone apex, where the server is authoritative
+	// for the zone itself rather than for a particular service or instance.
+	if question.Name == s.config.Domain {
+		switch question.Qtype {
+		case dns.TypeSOA:
+			response.Answer = append(response.Answer, s.createSOARecord())
+			response.SetRcode(request, dns.RcodeSuccess)
+			return nil
+		case dns.TypeNS:
+			response.Answer = append(response.Answer, s.createNSRecord())
+			response.SetRcode(request, dns.RcodeSuccess)
+			return nil
+		}
+	}
+
 	serviceInstances, err := s.retrieveServices(question, request, response)
 
 	if err != nil {
+		// NODATA/NXDOMAIN within our own zone: fall back to the recursors rather than
+		// failing the query outright.
+		if response.Rcode == dns.RcodeNameError && len(s.config.Recursors) > 0 {
+			return s.forwardQuestion(question, request, response)
+		}
 		return err
 	}
 	err = s.createRecordsForInstances(question, request, response, serviceInstances)
+	if err == nil && response.Rcode == dns.RcodeNameError && len(s.config.Recursors) > 0 {
+		return s.forwardQuestion(question, request, response)
+	}
 	return err
 
 }
 
+// forwardQuestion resolves a question via the configured recursors, in order, returning the
+// first successful reply. If every recursor fails, any NXDOMAIN/SOA already recorded for the
+// query stands as the final answer; otherwise the response is set to SERVFAIL.
+func (s *Server) forwardQuestion(question dns.Question, request, response *dns.Msg) error {
+	if len(s.config.Recursors) == 0 {
+		response.SetRcode(request, dns.RcodeNameError)
+		return fmt.Errorf("no recursors configured to resolve %s", question.Name)
+	}
+
+	timeout := s.config.RecursorTimeout
+	if timeout <= 0 {
+		timeout = defaultRecursorTimeout
+	}
+	dnsClient := &dns.Client{Net: "udp", Timeout: timeout}
+
+	forwardRequest := new(dns.Msg)
+	forwardRequest.SetQuestion(question.Name, question.Qtype)
+	forwardRequest.RecursionDesired = true
+
+	var lastErr error
+	for _, recursor := range s.config.Recursors {
+		reply, _, err := dnsClient.Exchange(forwardRequest, recursor)
+		if err != nil {
+			atomic.AddUint64(&s.recursorTimeouts, 1)
+			lastErr = err
+			continue
+		}
+
+		reply, err = s.chaseCNAMEs(dnsClient, reply, recursor)
+		if err != nil {
+			atomic.AddUint64(&s.recursorTimeouts, 1)
+			lastErr = err
+			continue
+		}
+
+		atomic.AddUint64(&s.forwardedQueries, 1)
+		response.Answer = append(response.Answer, reply.Answer...)
+		response.Ns = reply.Ns
+		response.Extra = append(response.Extra, reply.Extra...)
+		response.SetRcode(request, reply.Rcode)
+		response.Authoritative = false
+		response.RecursionAvailable = true
+		return nil
+	}
+
+	if response.Rcode != dns.RcodeNameError {
+		response.SetRcode(request, dns.RcodeServerFailure)
+	}
+	return fmt.Errorf("all recursors failed to resolve %s: %v", question.Name, lastErr)
+}
+
+// chaseCNAMEs follows a chain of CNAME answers against the same recursor, up to
+// maxCNAMEChases hops, appending each hop's records so the client gets the full chain.
+func (s *Server) chaseCNAMEs(dnsClient *dns.Client, reply *dns.Msg, recursor string) (*dns.Msg, error) {
+	for i := 0; i < maxCNAMEChases && len(reply.Answer) > 0; i++ {
+		cname, ok := reply.Answer[len(reply.Answer)-1].(*dns.CNAME)
+		if !ok {
+			break
+		}
+
+		follow := new(dns.Msg)
+		follow.SetQuestion(cname.Target, reply.Question[0].Qtype)
+		follow.RecursionDesired = true
+
+		next, _, err := dnsClient.Exchange(follow, recursor)
+		if err != nil {
+			return reply, err
+		}
+
+		reply.Answer = append(reply.Answer, next.Answer...)
+		reply.Ns = next.Ns
+		reply.Extra = append(reply.Extra, next.Extra...)
+		reply.Rcode = next.Rcode
+	}
+	return reply, nil
+}
+
+// ForwardedQueries returns the number of queries answered by a recursor.
+func (s *Server) ForwardedQueries() uint64 {
+	return atomic.LoadUint64(&s.forwardedQueries)
+}
+
+// RecursorTimeouts returns the number of recursor exchanges that failed or timed out.
+func (s *Server) RecursorTimeouts() uint64 {
+	return atomic.LoadUint64(&s.recursorTimeouts)
+}
+
 func (s *Server) retrieveServices(question dns.Question, request, response *dns.Msg) ([]*client.ServiceInstance, error) {
 	var serviceInstances []*client.ServiceInstance
 	var err error
@@ -162,7 +484,7 @@ func (s *Server) retrieveServices(question dns.Question, request, response *dns.
 	}
 	fullDomainRequestArray := dns.SplitDomainName(question.Name)
 	if len(fullDomainRequestArray) == 1 || len(fullDomainRequestArray) == 2 {
-		response.SetRcode(request, dns.RcodeNameError)
+		s.setNameError(request, response)
 		return nil, fmt.Errorf("service name wasn't included in domain %s", question.Name)
 	}
 	if fullDomainRequestArray[numberOfLabels-2] == "service" {
@@ -211,6 +533,7 @@ func (s *Server) retrieveInstancesForServiceQuery(serviceName string, request, r
 	// Dispatch query to registry
 	serviceInstances, err := s.config.DiscoveryClient.ListInstances(filters)
 	if err != nil {
+		s.config.Metrics.IncDiscoveryError()
 		response.SetRcode(request, dns.RcodeServerFailure)
 		return nil, err
 	}
@@ -233,6 +556,7 @@ func (s *Server) retrieveInstancesForServiceQuery(serviceName string, request, r
 func (s *Server) retrieveInstancesForInstanceQuery(instanceID string, request, response *dns.Msg) ([]*client.ServiceInstance, error) {
 	serviceInstances, err := s.config.DiscoveryClient.ListInstances(client.InstanceFilter{})
 	if err != nil {
+		s.config.Metrics.IncDiscoveryError()
 		response.SetRcode(request, dns.RcodeServerFailure)
 		return serviceInstances, err
 	}
@@ -241,10 +565,125 @@ func (s *Server) retrieveInstancesForInstanceQuery(instanceID string, request, r
 			return []*client.ServiceInstance{serviceInstance}, nil
 		}
 	}
-	response.SetRcode(request, dns.RcodeNameError)
+	s.setNameError(request, response)
 	return nil, fmt.Errorf("Error : didn't find a service with the id given %s", instanceID)
 }
 
+// setNameError sets the response to NXDOMAIN and attaches the zone's SOA record to the
+// authority section, as RFC 2308 recommends, so that resolvers can cache the negative answer.
+func (s *Server) setNameError(request, response *dns.Msg) {
+	response.SetRcode(request, dns.RcodeNameError)
+	response.Ns = append(response.Ns, s.createSOARecord())
+}
+
+// handlePTRQuestion answers reverse-lookup queries by decoding the address embedded in the
+// question name and matching it against every registered instance's endpoint, so the DNS
+// server can be used as a reverse zone for IP-to-name attribution (e.g. `dig -x <ip>`).
+func (s *Server) handlePTRQuestion(question dns.Question, request, response *dns.Msg) error {
+	ip, err := reverseAddrToIP(question.Name)
+	if err != nil {
+		response.SetRcode(request, dns.RcodeFormatError)
+		return err
+	}
+
+	serviceInstances, err := s.config.DiscoveryClient.ListInstances(client.InstanceFilter{})
+	if err != nil {
+		s.config.Metrics.IncDiscoveryError()
+		response.SetRcode(request, dns.RcodeServerFailure)
+		return err
+	}
+
+	ttl := s.resolveTTL("")
+	answer := make([]dns.RR, 0, 1)
+	for _, serviceInstance := range serviceInstances {
+		instanceIP, _, err := splitHostPort(serviceInstance.Endpoint)
+		if err != nil || !instanceIP.Equal(ip) {
+			continue
+		}
+		target := fmt.Sprintf("%s.instance.%s.", serviceInstance.ID, s.config.Domain)
+		answer = append(answer, createPTRRecord(question.Name, target, ttl))
+	}
+
+	if len(answer) == 0 {
+		s.setNameError(request, response)
+		return nil
+	}
+
+	response.Answer = append(response.Answer, answer...)
+	response.SetRcode(request, dns.RcodeSuccess)
+	return nil
+}
+
+// isReverseZoneName reports whether name falls under the in-addr.arpa or ip6.arpa reverse zones.
+func isReverseZoneName(name string) bool {
+	name = strings.ToLower(name)
+	return strings.HasSuffix(name, "in-addr.arpa.") || strings.HasSuffix(name, "ip6.arpa.")
+}
+
+// reverseAddrToIP decodes a name from the in-addr.arpa or ip6.arpa reverse zones back into
+// the net.IP it encodes, reversing the labels and joining the octets (IPv4) or nibbles (IPv6).
+func reverseAddrToIP(name string) (net.IP, error) {
+	labels := dns.SplitDomainName(name)
+	if len(labels) < 3 {
+		return nil, fmt.Errorf("invalid reverse-lookup name: %s", name)
+	}
+
+	switch strings.Join(labels[len(labels)-2:], ".") {
+	case "in-addr.arpa":
+		octets := labels[:len(labels)-2]
+		if len(octets) != 4 {
+			return nil, fmt.Errorf("invalid IPv4 reverse-lookup name: %s", name)
+		}
+		reversed := make([]string, 4)
+		for i, octet := range octets {
+			reversed[3-i] = octet
+		}
+		ip := net.ParseIP(strings.Join(reversed, "."))
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv4 reverse-lookup name: %s", name)
+		}
+		return ip, nil
+	case "ip6.arpa":
+		nibbles := labels[:len(labels)-2]
+		if len(nibbles) != 32 {
+			return nil, fmt.Errorf("invalid IPv6 reverse-lookup name: %s", name)
+		}
+		reversed := make([]byte, 32)
+		for i, nibble := range nibbles {
+			if len(nibble) != 1 {
+				return nil, fmt.Errorf("invalid IPv6 reverse-lookup name: %s", name)
+			}
+			reversed[31-i] = nibble[0]
+		}
+		var buf bytes.Buffer
+		for i, c := range reversed {
+			buf.WriteByte(c)
+			if i%4 == 3 && i != len(reversed)-1 {
+				buf.WriteByte(':')
+			}
+		}
+		ip := net.ParseIP(buf.String())
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv6 reverse-lookup name: %s", name)
+		}
+		return ip, nil
+	default:
+		return nil, fmt.Errorf("not a reverse-lookup name: %s", name)
+	}
+}
+
+func createPTRRecord(name, target string, ttl uint32) *dns.PTR {
+	return &dns.PTR{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypePTR,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		Ptr: target,
+	}
+}
+
 func (s *Server) createRecordsForInstances(question dns.Question, request, response *dns.Msg,
 	serviceInstances []*client.ServiceInstance) error {
 
@@ -259,40 +698,51 @@ func (s *Server) createRecordsForInstances(question dns.Question, request, respo
 			continue
 		}
 
+		ttl := s.resolveTTL(serviceInstance.ServiceName)
+
 		switch question.Qtype {
 		case dns.TypeA:
 			ipV4 := ip.To4()
 			if ipV4 != nil {
-				answer = append(answer, createARecord(question.Name, ipV4))
+				answer = append(answer, createARecord(question.Name, ipV4, ttl))
 			}
 		case dns.TypeAAAA:
 			ipV4 := ip.To4()
 			if ipV4 == nil {
-				answer = append(answer, createARecord(question.Name, ip.To16()))
+				answer = append(answer, createARecord(question.Name, ip.To16(), ttl))
 			}
 		case dns.TypeSRV:
 			target := fmt.Sprintf("%s.instance.%s.", serviceInstance.ID, s.config.Domain)
-			answer = append(answer, createSRVRecord(question.Name, port, target))
+			priority, weight := srvHints(serviceInstance.Tags)
+			answer = append(answer, createSRVRecord(question.Name, port, target, ttl, priority, weight))
 
 			ipV4 := ip.To4()
 			if ipV4 != nil {
-				extra = append(extra, createARecord(question.Name, ipV4))
+				extra = append(extra, createARecord(question.Name, ipV4, ttl))
 			} else {
-				extra = append(extra, createAAAARecord(question.Name, ip.To16()))
+				extra = append(extra, createAAAARecord(question.Name, ip.To16(), ttl))
 			}
 
 		}
 	}
 
 	if len(answer) == 0 {
-		response.SetRcode(request, dns.RcodeNameError)
+		s.setNameError(request, response)
 		return nil
 	}
 
-	// Poor-man's load balancing: randomize returned records order
-	shuffleRecords(answer)
+	// Poor-man's load balancing: randomize returned records order. SRV answers carry real
+	// RFC 2782 priority/weight, so preserve priority ordering and only shuffle within a
+	// priority band rather than the whole answer.
+	if question.Qtype == dns.TypeSRV {
+		shuffleSRVByPriority(answer)
+	} else {
+		shuffleRecords(answer)
+	}
 	shuffleRecords(extra)
 
+	s.config.Metrics.ObserveAnswerSize(dns.Type(question.Qtype).String(), len(answer))
+
 	response.Answer = append(response.Answer, answer...)
 	response.Extra = append(response.Extra, extra...)
 	response.SetRcode(request, dns.RcodeSuccess)
@@ -364,48 +814,138 @@ func splitHostPortHTTP(value string) (net.IP, uint16, error) {
 	return ip, port, nil
 }
 
-func createARecord(name string, ip net.IP) *dns.A {
+func createARecord(name string, ip net.IP, ttl uint32) *dns.A {
 	record := &dns.A{
 		Hdr: dns.RR_Header{
 			Name:   name,
 			Rrtype: dns.TypeA,
 			Class:  dns.ClassINET,
-			Ttl:    0,
+			Ttl:    ttl,
 		},
 		A: ip,
 	}
 	return record
 }
 
-func createAAAARecord(name string, ip net.IP) *dns.AAAA {
+func createAAAARecord(name string, ip net.IP, ttl uint32) *dns.AAAA {
 	record := &dns.AAAA{
 		Hdr: dns.RR_Header{
 			Name:   name,
 			Rrtype: dns.TypeAAAA,
 			Class:  dns.ClassINET,
-			Ttl:    0,
+			Ttl:    ttl,
 		},
 		AAAA: ip,
 	}
 	return record
 }
 
-func createSRVRecord(name string, port uint16, target string) *dns.SRV {
+func createSRVRecord(name string, port uint16, target string, ttl uint32, priority, weight uint16) *dns.SRV {
 	record := &dns.SRV{
 		Hdr: dns.RR_Header{
 			Name:   name,
 			Rrtype: dns.TypeSRV,
 			Class:  dns.ClassINET,
-			Ttl:    0,
+			Ttl:    ttl,
 		},
 		Port:     port,
-		Priority: 0,
-		Weight:   0,
+		Priority: priority,
+		Weight:   weight,
 		Target:   target,
 	}
 	return record
 }
 
+// srvHints extracts RFC 2782 priority/weight hints from an instance's tags, formatted as
+// "priority=<n>" and "weight=<n>". An instance with no weight tag gets defaultSRVWeight.
+func srvHints(tags []string) (priority, weight uint16) {
+	weight = defaultSRVWeight
+	for _, tag := range tags {
+		if v, ok := parseSRVTag(tag, srvPriorityTagPrefix); ok {
+			priority = v
+		} else if v, ok := parseSRVTag(tag, srvWeightTagPrefix); ok {
+			weight = v
+		}
+	}
+	return priority, weight
+}
+
+func parseSRVTag(tag, prefix string) (uint16, bool) {
+	if !strings.HasPrefix(tag, prefix) {
+		return 0, false
+	}
+	n, err := strconv.Atoi(tag[len(prefix):])
+	if err != nil || n < 0 || n > 0xffff {
+		return 0, false
+	}
+	return uint16(n), true
+}
+
+// shuffleSRVByPriority sorts SRV records by ascending priority (RFC 2782: lower value tried
+// first) and randomizes order only within each priority band, so clients can still perform
+// weighted selection among same-priority records.
+func shuffleSRVByPriority(records []dns.RR) {
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].(*dns.SRV).Priority < records[j].(*dns.SRV).Priority
+	})
+
+	start := 0
+	for start < len(records) {
+		priority := records[start].(*dns.SRV).Priority
+		end := start + 1
+		for end < len(records) && records[end].(*dns.SRV).Priority == priority {
+			end++
+		}
+		shuffleRecords(records[start:end])
+		start = end
+	}
+}
+
+// resolveTTL returns the TTL to use for records of the given service, preferring a
+// per-service override in Config.ServiceTTL and falling back to Config.DefaultTTL.
+func (s *Server) resolveTTL(serviceName string) uint32 {
+	if ttl, ok := s.config.ServiceTTL[serviceName]; ok {
+		return uint32(ttl.Seconds())
+	}
+	return uint32(s.config.DefaultTTL.Seconds())
+}
+
+// createSOARecord synthesizes the zone's SOA record from Config.SOA, so the server can
+// participate as an authoritative zone that other resolvers cache and delegate to.
+func (s *Server) createSOARecord() *dns.SOA {
+	zone := s.config.Domain
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   zone,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    s.config.SOA.MinTTL,
+		},
+		Ns:      "ns." + zone,
+		Mbox:    "hostmaster." + zone,
+		Serial:  1,
+		Refresh: s.config.SOA.Refresh,
+		Retry:   s.config.SOA.Retry,
+		Expire:  s.config.SOA.Expire,
+		Minttl:  s.config.SOA.MinTTL,
+	}
+}
+
+// createNSRecord answers TypeNS queries against the zone apex with the server's own name,
+// so the zone can be delegated to it cleanly.
+func (s *Server) createNSRecord() *dns.NS {
+	zone := s.config.Domain
+	return &dns.NS{
+		Hdr: dns.RR_Header{
+			Name:   zone,
+			Rrtype: dns.TypeNS,
+			Class:  dns.ClassINET,
+			Ttl:    s.config.SOA.MinTTL,
+		},
+		Ns: "ns." + zone,
+	}
+}
+
 func validate(config *Config) error {
 	if config.DiscoveryClient == nil {
 		return fmt.Errorf("Discovery client is nil")
@@ -413,6 +953,10 @@ func validate(config *Config) error {
 
 	config.Domain = dns.Fqdn(config.Domain)
 
+	if config.Metrics == nil {
+		config.Metrics = noopMetrics{}
+	}
+
 	return nil
 }
 